@@ -0,0 +1,193 @@
+// Package flatmap decodes the flatmap encoding Terraform uses to represent
+// nested lists, sets, and maps in terraform.InstanceState attributes back into
+// native Go values.
+package flatmap
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Expand decodes the value at key in attrs into a Go value: a
+// []interface{} when key is a TypeList or TypeSet, a map[string]interface{}
+// when key is a TypeMap, or the raw string for a scalar. Collections nested
+// inside each element are expanded recursively, so a set of objects that
+// themselves contain lists or sets decodes into native Go values rather than
+// flat strings.
+func Expand(attrs map[string]string, key string) (interface{}, error) {
+	if countStr, ok := attrs[key+".#"]; ok {
+		return expandCollection(attrs, key, countStr)
+	}
+
+	if countStr, ok := attrs[key+".%"]; ok {
+		count, err := strconv.ParseInt(countStr, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("flatmap: invalid count for %q: %w", key, err)
+		}
+		if count == 0 {
+			return map[string]interface{}{}, nil
+		}
+
+		result := make(map[string]interface{}, count)
+		for _, id := range elementIDs(attrs, key) {
+			element, err := expandElement(attrs, key+"."+id)
+			if err != nil {
+				return nil, err
+			}
+			result[id] = element
+		}
+		return result, nil
+	}
+
+	value, ok := attrs[key]
+	if !ok {
+		return nil, fmt.Errorf("flatmap: no value for %q", key)
+	}
+	return value, nil
+}
+
+func expandCollection(attrs map[string]string, key, countStr string) (interface{}, error) {
+	count, err := strconv.ParseInt(countStr, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("flatmap: invalid count for %q: %w", key, err)
+	}
+	// Guard against the count==0 case so we don't descend into an orphaned
+	// zero-count child and report an element that isn't really there.
+	if count == 0 {
+		return []interface{}{}, nil
+	}
+
+	ids := elementIDs(attrs, key)
+	elements := make([]interface{}, 0, len(ids))
+	for _, id := range ids {
+		element, err := expandElement(attrs, key+"."+id)
+		if err != nil {
+			return nil, err
+		}
+		elements = append(elements, element)
+	}
+	return elements, nil
+}
+
+// expandElement decodes a single list/set/map element at elementKey, which
+// is either a scalar value stored directly at elementKey, or an object whose
+// fields are nested under elementKey.<field>.
+func expandElement(attrs map[string]string, elementKey string) (interface{}, error) {
+	if value, ok := attrs[elementKey]; ok {
+		return value, nil
+	}
+
+	seen := make(map[string]bool)
+	var fields []string
+	searchPrefix := elementKey + "."
+	for attr := range attrs {
+		if !strings.HasPrefix(attr, searchPrefix) {
+			continue
+		}
+		field := strings.SplitN(strings.TrimPrefix(attr, searchPrefix), ".", 2)[0]
+		if !seen[field] {
+			seen[field] = true
+			fields = append(fields, field)
+		}
+	}
+
+	object := make(map[string]interface{}, len(fields))
+	for _, field := range fields {
+		value, err := Expand(attrs, elementKey+"."+field)
+		if err != nil {
+			return nil, err
+		}
+		object[field] = value
+	}
+	return object, nil
+}
+
+// elementIDs returns the element IDs (a sequential index for a TypeList, or
+// a hashed set ID for a TypeSet) found directly under key in attrs, in
+// ascending numeric order. A TypeList's sequential indices are meaningful
+// order and must come out sorted; a TypeSet's hashed IDs have no meaningful
+// order, but are numeric too, so sorting them ascending is harmless and
+// keeps the result deterministic either way.
+func elementIDs(attrs map[string]string, key string) []string {
+	seen := make(map[string]bool)
+	var ids []string
+	searchPrefix := key + "."
+	for attr := range attrs {
+		if !strings.HasPrefix(attr, searchPrefix) {
+			continue
+		}
+		id := strings.SplitN(strings.TrimPrefix(attr, searchPrefix), ".", 2)[0]
+		if id == "#" || id == "%" || seen[id] {
+			continue
+		}
+		seen[id] = true
+		ids = append(ids, id)
+	}
+	sortElementIDs(ids)
+	return ids
+}
+
+// sortElementIDs sorts ids ascending by numeric value when every ID parses
+// as an integer, which covers both a TypeList's sequential indices and a
+// TypeSet's numeric hashcodes. If some ID doesn't parse as a number, it is
+// sorted lexicographically instead purely for determinism.
+func sortElementIDs(ids []string) {
+	for _, id := range ids {
+		if _, err := strconv.Atoi(id); err != nil {
+			sort.Strings(ids)
+			return
+		}
+	}
+
+	sort.Slice(ids, func(i, j int) bool {
+		a, _ := strconv.Atoi(ids[i])
+		b, _ := strconv.Atoi(ids[j])
+		return a < b
+	})
+}
+
+// ExpandSet decodes the TypeList or TypeSet at key, whose elements are
+// objects, into one map[string]string per element keyed by the element's
+// own attribute paths relative to key. Unlike Expand, it does not recurse
+// into collections nested inside each element, leaving their flatmap keys
+// (e.g. "action.#", "action.0.target") intact for the caller to walk.
+func ExpandSet(attrs map[string]string, key string) ([]map[string]string, error) {
+	countStr, ok := attrs[key+".#"]
+	if !ok {
+		return nil, fmt.Errorf("flatmap: %q does not appear to be a TypeList or TypeSet", key)
+	}
+	count, err := strconv.ParseInt(countStr, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("flatmap: invalid count for %q: %w", key, err)
+	}
+	if count == 0 {
+		return []map[string]string{}, nil
+	}
+
+	ids := elementIDs(attrs, key)
+	elements := make([]map[string]string, len(ids))
+	for i := range ids {
+		elements[i] = make(map[string]string)
+	}
+	index := make(map[string]int, len(ids))
+	for i, id := range ids {
+		index[id] = i
+	}
+
+	searchPrefix := key + "."
+	for attr, value := range attrs {
+		if !strings.HasPrefix(attr, searchPrefix) {
+			continue
+		}
+		rest := strings.TrimPrefix(attr, searchPrefix)
+		parts := strings.SplitN(rest, ".", 2)
+		if parts[0] == "#" || len(parts) != 2 {
+			continue
+		}
+		elements[index[parts[0]]][parts[1]] = value
+	}
+
+	return elements, nil
+}
@@ -0,0 +1,154 @@
+package flatmap
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExpand(t *testing.T) {
+	testCases := []struct {
+		name  string
+		attrs map[string]string
+		key   string
+		want  interface{}
+	}{
+		{
+			name:  "scalar",
+			attrs: map[string]string{"name": "foo"},
+			key:   "name",
+			want:  "foo",
+		},
+		{
+			name: "list of scalars",
+			attrs: map[string]string{
+				"ports.#": "2",
+				"ports.0": "80",
+				"ports.1": "443",
+			},
+			key:  "ports",
+			want: []interface{}{"80", "443"},
+		},
+		{
+			name: "list of scalars is returned in ascending index order regardless of map iteration order",
+			attrs: map[string]string{
+				"ports.#": "3",
+				"ports.2": "8080",
+				"ports.0": "80",
+				"ports.1": "443",
+			},
+			key:  "ports",
+			want: []interface{}{"80", "443", "8080"},
+		},
+		{
+			name:  "empty list does not descend into an orphaned child",
+			attrs: map[string]string{"ports.#": "0", "ports.0": "orphan"},
+			key:   "ports",
+			want:  []interface{}{},
+		},
+		{
+			name: "map",
+			attrs: map[string]string{
+				"tags.%":    "2",
+				"tags.Name": "example",
+				"tags.Env":  "test",
+			},
+			key:  "tags",
+			want: map[string]interface{}{"Name": "example", "Env": "test"},
+		},
+		{
+			name:  "empty map",
+			attrs: map[string]string{"tags.%": "0"},
+			key:   "tags",
+			want:  map[string]interface{}{},
+		},
+		{
+			name: "set of objects with a nested list of scalars",
+			attrs: map[string]string{
+				"rule.#":                   "1",
+				"rule.0.name":              "main",
+				"rule.0.action.#":          "2",
+				"rule.0.action.20.target":  "b",
+				"rule.0.action.10.target":  "a",
+				"rule.0.action.10.ports.#": "2",
+				"rule.0.action.10.ports.0": "22",
+				"rule.0.action.10.ports.1": "23",
+				"rule.0.action.20.ports.#": "0",
+			},
+			key: "rule",
+			want: []interface{}{
+				map[string]interface{}{
+					"name": "main",
+					"action": []interface{}{
+						map[string]interface{}{
+							"target": "a",
+							"ports":  []interface{}{"22", "23"},
+						},
+						map[string]interface{}{
+							"target": "b",
+							"ports":  []interface{}{},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := Expand(tc.attrs, tc.key)
+			if err != nil {
+				t.Fatalf("Expand(%q) returned error: %s", tc.key, err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("Expand(%q) = %#v, want %#v", tc.key, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestExpandNoValue(t *testing.T) {
+	if _, err := Expand(map[string]string{}, "missing"); err == nil {
+		t.Fatal("expected an error for a key with no value in attrs")
+	}
+}
+
+func TestExpandSet(t *testing.T) {
+	attrs := map[string]string{
+		"rule.#":           "2",
+		"rule.10.name":     "first",
+		"rule.10.action.#": "1",
+		"rule.10.action.0": "allow",
+		"rule.20.name":     "second",
+		"rule.20.action.#": "1",
+		"rule.20.action.0": "deny",
+	}
+
+	elements, err := ExpandSet(attrs, "rule")
+	if err != nil {
+		t.Fatalf("ExpandSet returned error: %s", err)
+	}
+
+	want := []map[string]string{
+		{"name": "first", "action.#": "1", "action.0": "allow"},
+		{"name": "second", "action.#": "1", "action.0": "deny"},
+	}
+	if !reflect.DeepEqual(elements, want) {
+		t.Fatalf("ExpandSet(rule) = %#v, want %#v", elements, want)
+	}
+}
+
+func TestExpandSetEmpty(t *testing.T) {
+	elements, err := ExpandSet(map[string]string{"rule.#": "0"}, "rule")
+	if err != nil {
+		t.Fatalf("ExpandSet returned error: %s", err)
+	}
+	if len(elements) != 0 {
+		t.Fatalf("ExpandSet(rule) = %#v, want an empty slice", elements)
+	}
+}
+
+func TestExpandSetNotATypeSet(t *testing.T) {
+	if _, err := ExpandSet(map[string]string{"name": "foo"}, "name"); err == nil {
+		t.Fatal("expected an error for a key that is not a TypeList/TypeSet")
+	}
+}
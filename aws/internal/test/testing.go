@@ -2,13 +2,123 @@ package test
 
 import (
 	"fmt"
+	"regexp"
 	"strconv"
 	"strings"
 
+	"github.com/hashicorp/go-multierror"
 	"github.com/hashicorp/terraform-plugin-sdk/helper/resource"
 	"github.com/hashicorp/terraform-plugin-sdk/terraform"
+	"github.com/terraform-providers/terraform-provider-aws/aws/internal/flatmap"
 )
 
+// typeSetElemWildcard is the sentinel that may be substituted for any list or
+// set index in a key passed to TestCheckTypeSetElemNestedAttrs,
+// TestCheckTypeSetElemAttr, or the nested attr/value pairs passed alongside
+// them, e.g. "rule.*.action.*.target". It stands in for any numeric index or
+// hashed set ID found in State at that position.
+const typeSetElemWildcard = "*"
+
+// resolveTypeSetElemWildcards expands every "*" in keyParts against attrs,
+// returning the dotted flatmap key formed by each concrete index/ID found at
+// that position. If keyParts contains no wildcard, the single fully
+// qualified key is returned.
+func resolveTypeSetElemWildcards(attrs map[string]string, prefix string, keyParts []string) []string {
+	if len(keyParts) == 0 {
+		return []string{prefix}
+	}
+
+	part := keyParts[0]
+	if part != typeSetElemWildcard {
+		return resolveTypeSetElemWildcards(attrs, appendFlatmapKey(prefix, part), keyParts[1:])
+	}
+
+	searchPrefix := prefix + "."
+	ids := make(map[string]bool)
+	for attr := range attrs {
+		if !strings.HasPrefix(attr, searchPrefix) {
+			continue
+		}
+		id := strings.SplitN(strings.TrimPrefix(attr, searchPrefix), ".", 2)[0]
+		if id == "#" || id == "%" {
+			continue
+		}
+		ids[id] = true
+	}
+
+	var resolved []string
+	for id := range ids {
+		resolved = append(resolved, resolveTypeSetElemWildcards(attrs, appendFlatmapKey(prefix, id), keyParts[1:])...)
+	}
+	return resolved
+}
+
+func appendFlatmapKey(prefix, part string) string {
+	if prefix == "" {
+		return part
+	}
+	return prefix + "." + part
+}
+
+// typeSetElemAttrMatches reports whether element, a decoded TypeSet member
+// keyed by its attribute paths relative to the set, satisfies the
+// attribute/value pair. key may itself contain the "*" wildcard (e.g.
+// "action.*.target") to match a nested collection without pinning its index.
+func typeSetElemAttrMatches(element map[string]string, key, value string) bool {
+	if !strings.Contains(key, typeSetElemWildcard) {
+		stateValue, ok := element[key]
+		return ok && stateValue == value
+	}
+
+	for _, candidate := range resolveTypeSetElemWildcards(element, "", strings.Split(key, ".")) {
+		if stateValue, ok := element[candidate]; ok && stateValue == value {
+			return true
+		}
+	}
+	return false
+}
+
+// typeSetElemAttrMatchesRegex is the regexp analog of typeSetElemAttrMatches,
+// used by TestMatchTypeSetElemNestedAttrs: element's attribute at key must
+// match r rather than equal an exact string.
+func typeSetElemAttrMatchesRegex(element map[string]string, key string, r *regexp.Regexp) bool {
+	if !strings.Contains(key, typeSetElemWildcard) {
+		stateValue, ok := element[key]
+		return ok && r.MatchString(stateValue)
+	}
+
+	for _, candidate := range resolveTypeSetElemWildcards(element, "", strings.Split(key, ".")) {
+		if stateValue, ok := element[candidate]; ok && r.MatchString(stateValue) {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeTypeSetElems unflattens the TypeSet at a fully resolved (no
+// wildcards) flatmap key into its member elements, keyed by their position
+// in state. found is false when key does not appear to be a TypeSet in
+// attrs. This is shared by every Check/Match function that needs to inspect
+// a TypeSet's nested attrs, deferring to the flatmap package for the actual
+// unflattening.
+func decodeTypeSetElems(attrs map[string]string, key string) (elements map[string]map[string]string, count int64, found bool, err error) {
+	if _, ok := attrs[key+".#"]; !ok {
+		return nil, 0, false, nil
+	}
+
+	decoded, err := flatmap.ExpandSet(attrs, key)
+	if err != nil {
+		return nil, 0, true, err
+	}
+
+	elements = make(map[string]map[string]string, len(decoded))
+	for i, element := range decoded {
+		elements[strconv.Itoa(i)] = element
+	}
+
+	return elements, int64(len(decoded)), true, nil
+}
+
 // TestCheckTypeSetElemNestedAttrs is a resource.TestCheckFunc that accepts a resource
 // name and flatmap style key to a schema.TypeSet attribute. The function checks
 // if it appears to be a schema.TypeSet and then verifies that an element in
@@ -20,6 +130,13 @@ import (
 // Please note, if the provided value map is not granular enough, there exists
 // the possibility you match an element you were not intending to, in the TypeSet.
 // Provide a full mapping of attributes to be sure the unique element exists.
+//
+// key may contain the "*" wildcard in place of any list/set index, e.g.
+// "rule.*.action.*.target", to match a TypeSet nested several levels deep
+// without first resolving the indexes of the intervening collections. The
+// values map may also use "*" within its own keys (e.g. "action.*.field") to
+// assert against a nested collection inside the matched element without
+// pinning its index.
 func TestCheckTypeSetElemNestedAttrs(name, key string, values map[string]string) resource.TestCheckFunc {
 	return func(s *terraform.State) error {
 		ms := s.RootModule()
@@ -33,59 +150,147 @@ func TestCheckTypeSetElemNestedAttrs(name, key string, values map[string]string)
 			return fmt.Errorf("No primary instance: %s in %s", name, ms.Path)
 		}
 
-		// A TypeSet should have a special count attribute
-		countStr, ok := is.Attributes[key+".#"]
-		if !ok {
+		var foundTypeSet bool
+		for _, key := range resolveTypeSetElemWildcards(is.Attributes, "", strings.Split(key, ".")) {
+			elements, _, found, err := decodeTypeSetElems(is.Attributes, key)
+			if err != nil {
+				return err
+			}
+			if !found {
+				continue
+			}
+			foundTypeSet = true
+
+			// check if an element is a full match with the passed values map
+			for _, element := range elements {
+				var matches int
+				for k, v := range values {
+					if typeSetElemAttrMatches(element, k, v) {
+						matches++
+					}
+				}
+				if matches == len(values) {
+					return nil
+				}
+			}
+		}
+
+		if !foundTypeSet {
 			return fmt.Errorf("%q %q does not appear to be a TypeSet", name, key)
 		}
-		count, err := strconv.ParseInt(countStr, 10, 64)
-		if err != nil {
-			return err
-		}
-
-		// unflatten the TypeSet from State
-		passedKeyParts := strings.Split(key, ".")
-		elements := make(map[string]map[string]string, count)
-		for stateKey, stateValue := range is.Attributes {
-			stateKeyParts := strings.Split(stateKey, ".")
-			if strings.HasPrefix(stateKey, key) {
-				id := stateKeyParts[len(passedKeyParts)]
-				if id != "#" {
-					element, ok := elements[id]
-					if !ok {
-						elements[id] = make(map[string]string)
-						element = elements[id]
-					}
 
-					element[strings.Join(stateKeyParts[len(passedKeyParts)+1:], ".")] = stateValue
+		return fmt.Errorf("No TypeSet element with attr/value pairs: %#v in state: %#v", values, is.Attributes)
+	}
+}
 
-					// this maybe be redundant.. never sure
-					elements[id] = element
+// TestMatchTypeSetElemNestedAttrs is the regexp analog of
+// TestCheckTypeSetElemNestedAttrs: an element in the TypeSet at key matches
+// when every regexp in values matches its corresponding element attribute's
+// string value. Use this over TestCheckTypeSetElemNestedAttrs when an
+// attribute's value is generated (ARNs, IDs, timestamps) and cannot be
+// pinned to an exact string, mirroring the SDK's TestMatchResourceAttr.
+//
+// key and the keys of values may contain the "*" wildcard exactly as in
+// TestCheckTypeSetElemNestedAttrs.
+func TestMatchTypeSetElemNestedAttrs(name, key string, values map[string]*regexp.Regexp) resource.TestCheckFunc {
+	return func(s *terraform.State) error {
+		ms := s.RootModule()
+		rs, ok := ms.Resources[name]
+		if !ok {
+			return fmt.Errorf("Not found: %s in %s", name, ms.Path)
+		}
+
+		is := rs.Primary
+		if is == nil {
+			return fmt.Errorf("No primary instance: %s in %s", name, ms.Path)
+		}
+
+		var foundTypeSet bool
+		for _, key := range resolveTypeSetElemWildcards(is.Attributes, "", strings.Split(key, ".")) {
+			elements, _, found, err := decodeTypeSetElems(is.Attributes, key)
+			if err != nil {
+				return err
+			}
+			if !found {
+				continue
+			}
+			foundTypeSet = true
+
+			for _, element := range elements {
+				var matches int
+				for k, r := range values {
+					if typeSetElemAttrMatchesRegex(element, k, r) {
+						matches++
+					}
+				}
+				if matches == len(values) {
+					return nil
 				}
 			}
 		}
 
-		// Sanity check
-		// This is helpful for me but maybe shouldn't exist? As stated it indicates
-		// a bug in this function or something unexpected in State?
-		if len(elements) != int(count) {
-			fmt.Errorf("Expecting the number of set items to be %d, got %d.\nThis could be a bug in the TestCheckTypeSetElemNestedAttrs function, or less likely a bug in the SDK/State", count, len(elements))
+		if !foundTypeSet {
+			return fmt.Errorf("%q %q does not appear to be a TypeSet", name, key)
 		}
 
-		// check if an element is a full match with the passed values map
-		for _, element := range elements {
-			var matches int
-			for k, v := range values {
-				if stateValue, keyExists := element[k]; keyExists && stateValue == v {
-					matches++
-				}
+		return fmt.Errorf("No TypeSet element with attr/regexp pairs: %#v in state: %#v", values, is.Attributes)
+	}
+}
+
+// TestCheckTypeSetElemNestedAttrsWith is a resource.TestCheckFunc that accepts a
+// resource name and flatmap style key to a schema.TypeSet attribute, and hands
+// every decoded element to check. It succeeds if check returns nil for at least
+// one element in the set, and otherwise fails with check's aggregated errors
+// from every element it was tried against.
+//
+// This imports the SDK's TestCheckResourceAttrWith idea into the set domain, so
+// tests can assert a relationship between attributes of the same element (e.g.
+// "port == target_port + 1000") that cannot be expressed by the equality-only
+// values map accepted by TestCheckTypeSetElemNestedAttrs.
+//
+// key may contain the "*" wildcard exactly as in TestCheckTypeSetElemNestedAttrs.
+func TestCheckTypeSetElemNestedAttrsWith(name, key string, check func(element map[string]string) error) resource.TestCheckFunc {
+	return func(s *terraform.State) error {
+		ms := s.RootModule()
+		rs, ok := ms.Resources[name]
+		if !ok {
+			return fmt.Errorf("Not found: %s in %s", name, ms.Path)
+		}
+
+		is := rs.Primary
+		if is == nil {
+			return fmt.Errorf("No primary instance: %s in %s", name, ms.Path)
+		}
+
+		var foundTypeSet bool
+		var errs *multierror.Error
+		for _, key := range resolveTypeSetElemWildcards(is.Attributes, "", strings.Split(key, ".")) {
+			elements, _, found, err := decodeTypeSetElems(is.Attributes, key)
+			if err != nil {
+				return err
 			}
-			if matches == len(values) {
-				return nil
+			if !found {
+				continue
+			}
+			foundTypeSet = true
+
+			for id, element := range elements {
+				if err := check(element); err == nil {
+					return nil
+				} else {
+					errs = multierror.Append(errs, fmt.Errorf("%s.%s: %w", key, id, err))
+				}
 			}
 		}
 
-		return fmt.Errorf("No TypeSet element with attr/value pairs: %#v in state: %#v", values, is.Attributes)
+		if !foundTypeSet {
+			return fmt.Errorf("%q %q does not appear to be a TypeSet", name, key)
+		}
+		if errs == nil {
+			return fmt.Errorf("No TypeSet element of %q %q satisfied check", name, key)
+		}
+
+		return errs.ErrorOrNil()
 	}
 }
 
@@ -96,6 +301,10 @@ func TestCheckTypeSetElemNestedAttrs(name, key string, values map[string]string)
 //
 // Use this function over SDK provided TestCheckFunctions when validating a
 // TypeSet where its elements are a simple value
+//
+// key may contain the "*" wildcard in place of any list/set index, e.g.
+// "rule.*.ports", to match a TypeSet nested inside another collection
+// without first resolving the indexes of the intervening collections.
 func TestCheckTypeSetElemAttr(name, key, value string) resource.TestCheckFunc {
 	return func(s *terraform.State) error {
 		ms := s.RootModule()
@@ -109,20 +318,217 @@ func TestCheckTypeSetElemAttr(name, key, value string) resource.TestCheckFunc {
 			return fmt.Errorf("No primary instance: %s in %s", name, ms.Path)
 		}
 
-		// A TypeSet should have a special count attribute
-		if _, ok := is.Attributes[key+".#"]; !ok {
+		for _, key := range resolveTypeSetElemWildcards(is.Attributes, "", strings.Split(key, ".")) {
+			// A TypeSet should have a special count attribute
+			if _, ok := is.Attributes[key+".#"]; !ok {
+				continue
+			}
+
+			for stateKey, stateValue := range is.Attributes {
+				parts := strings.Split(stateKey, ".")
+				// ensure the passed key is in fact the direct path to the supposed
+				// TypeSet and the values match
+				if stateValue == value && key == strings.Join(parts[:len(parts)-1], ".") {
+					return nil
+				}
+			}
+		}
+
+		return fmt.Errorf("No TypeSet element with value: %q in state: %#v", value, is.Attributes)
+	}
+}
+
+// TestMatchTypeSetElemAttr is the regexp analog of TestCheckTypeSetElemAttr:
+// an element in the TypeSet at key matches when r matches its string value,
+// mirroring the SDK's TestMatchResourceAttr.
+//
+// key may contain the "*" wildcard exactly as in TestCheckTypeSetElemAttr.
+func TestMatchTypeSetElemAttr(name, key string, r *regexp.Regexp) resource.TestCheckFunc {
+	return func(s *terraform.State) error {
+		ms := s.RootModule()
+		rs, ok := ms.Resources[name]
+		if !ok {
+			return fmt.Errorf("Not found: %s in %s", name, ms.Path)
+		}
+
+		is := rs.Primary
+		if is == nil {
+			return fmt.Errorf("No primary instance: %s in %s", name, ms.Path)
+		}
+
+		for _, key := range resolveTypeSetElemWildcards(is.Attributes, "", strings.Split(key, ".")) {
+			// A TypeSet should have a special count attribute
+			if _, ok := is.Attributes[key+".#"]; !ok {
+				continue
+			}
+
+			for stateKey, stateValue := range is.Attributes {
+				parts := strings.Split(stateKey, ".")
+				// ensure the passed key is in fact the direct path to the supposed
+				// TypeSet, that it is not the special count attribute, and that the
+				// value matches
+				if parts[len(parts)-1] != "#" && r.MatchString(stateValue) && key == strings.Join(parts[:len(parts)-1], ".") {
+					return nil
+				}
+			}
+		}
+
+		return fmt.Errorf("No TypeSet element matching: %s in state: %#v", r, is.Attributes)
+	}
+}
+
+// TestCheckTypeSetElemAttrWith is the scalar analog of
+// TestCheckTypeSetElemNestedAttrsWith: check is handed every element of the
+// TypeSet at key and the overall check succeeds if it returns nil for at
+// least one of them, otherwise failing with check's aggregated errors from
+// every element it was tried against.
+//
+// key may contain the "*" wildcard exactly as in TestCheckTypeSetElemAttr.
+func TestCheckTypeSetElemAttrWith(name, key string, check func(value string) error) resource.TestCheckFunc {
+	return func(s *terraform.State) error {
+		ms := s.RootModule()
+		rs, ok := ms.Resources[name]
+		if !ok {
+			return fmt.Errorf("Not found: %s in %s", name, ms.Path)
+		}
+
+		is := rs.Primary
+		if is == nil {
+			return fmt.Errorf("No primary instance: %s in %s", name, ms.Path)
+		}
+
+		var foundTypeSet bool
+		var errs *multierror.Error
+		for _, key := range resolveTypeSetElemWildcards(is.Attributes, "", strings.Split(key, ".")) {
+			// A TypeSet should have a special count attribute
+			if _, ok := is.Attributes[key+".#"]; !ok {
+				continue
+			}
+			foundTypeSet = true
+
+			for stateKey, stateValue := range is.Attributes {
+				parts := strings.Split(stateKey, ".")
+				// ensure the passed key is in fact the direct path to the supposed
+				// TypeSet, and skip its special count attribute
+				if key != strings.Join(parts[:len(parts)-1], ".") || parts[len(parts)-1] == "#" {
+					continue
+				}
+
+				if err := check(stateValue); err == nil {
+					return nil
+				} else {
+					errs = multierror.Append(errs, fmt.Errorf("%s: %w", stateKey, err))
+				}
+			}
+		}
+
+		if !foundTypeSet {
 			return fmt.Errorf("%s %q does not appear to be a TypeSet", name, key)
 		}
+		if errs == nil {
+			return fmt.Errorf("No TypeSet element of %s %q satisfied check", name, key)
+		}
+
+		return errs.ErrorOrNil()
+	}
+}
+
+// TestCheckNoTypeSetElemNestedAttrs is a resource.TestCheckFunc that accepts
+// a resource name and flatmap style key to a schema.TypeSet attribute. It
+// succeeds only when no element in the set matches all of the given
+// attribute/value pairs.
+//
+// Use this to assert that an element removed by a config update (e.g. to
+// test ForceNew behavior on a set member, or drift-correction) is in fact
+// gone from the set, which TestCheckTypeSetElemNestedAttrs alone cannot
+// express since it only asserts presence.
+//
+// key may contain the "*" wildcard exactly as in TestCheckTypeSetElemNestedAttrs.
+func TestCheckNoTypeSetElemNestedAttrs(name, key string, values map[string]string) resource.TestCheckFunc {
+	return func(s *terraform.State) error {
+		ms := s.RootModule()
+		rs, ok := ms.Resources[name]
+		if !ok {
+			return fmt.Errorf("Not found: %s in %s", name, ms.Path)
+		}
 
-		for stateKey, stateValue := range is.Attributes {
-			parts := strings.Split(stateKey, ".")
-			// ensure the passed key is in fact the direct path to the supposed
-			// TypeSet and the values match
-			if stateValue == value && key == strings.Join(parts[:len(parts)-1], ".") {
-				return nil
+		is := rs.Primary
+		if is == nil {
+			return fmt.Errorf("No primary instance: %s in %s", name, ms.Path)
+		}
+
+		for _, key := range resolveTypeSetElemWildcards(is.Attributes, "", strings.Split(key, ".")) {
+			elements, _, found, err := decodeTypeSetElems(is.Attributes, key)
+			if err != nil {
+				return err
+			}
+			if !found {
+				continue
+			}
+
+			for id, element := range elements {
+				var matches int
+				for k, v := range values {
+					if typeSetElemAttrMatches(element, k, v) {
+						matches++
+					}
+				}
+				if matches == len(values) {
+					return fmt.Errorf("Unexpected TypeSet element %s.%s with attr/value pairs: %#v in state: %#v", key, id, values, is.Attributes)
+				}
 			}
 		}
 
-		return fmt.Errorf("No TypeSet element with value: %q in state: %#v", value, is.Attributes)
+		return nil
+	}
+}
+
+// TestCheckTypeSetElemNestedAttrsCount is a resource.TestCheckFunc that
+// accepts a resource name and flatmap style key to a schema.TypeSet
+// attribute. It succeeds only when exactly expected elements in the set
+// match all of the given attribute/value pairs.
+//
+// key may contain the "*" wildcard exactly as in TestCheckTypeSetElemNestedAttrs.
+func TestCheckTypeSetElemNestedAttrsCount(name, key string, values map[string]string, expected int) resource.TestCheckFunc {
+	return func(s *terraform.State) error {
+		ms := s.RootModule()
+		rs, ok := ms.Resources[name]
+		if !ok {
+			return fmt.Errorf("Not found: %s in %s", name, ms.Path)
+		}
+
+		is := rs.Primary
+		if is == nil {
+			return fmt.Errorf("No primary instance: %s in %s", name, ms.Path)
+		}
+
+		var matchingElements int
+		for _, key := range resolveTypeSetElemWildcards(is.Attributes, "", strings.Split(key, ".")) {
+			elements, _, found, err := decodeTypeSetElems(is.Attributes, key)
+			if err != nil {
+				return err
+			}
+			if !found {
+				continue
+			}
+
+			for _, element := range elements {
+				var matches int
+				for k, v := range values {
+					if typeSetElemAttrMatches(element, k, v) {
+						matches++
+					}
+				}
+				if matches == len(values) {
+					matchingElements++
+				}
+			}
+		}
+
+		if matchingElements != expected {
+			return fmt.Errorf("Expected %d TypeSet elements with attr/value pairs: %#v, got %d in state: %#v", expected, values, matchingElements, is.Attributes)
+		}
+
+		return nil
 	}
 }
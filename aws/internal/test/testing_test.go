@@ -0,0 +1,191 @@
+package test
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/terraform-plugin-sdk/terraform"
+)
+
+func testTypeSetState() *terraform.State {
+	return &terraform.State{
+		Modules: []*terraform.ModuleState{
+			{
+				Path: []string{"root"},
+				Resources: map[string]*terraform.ResourceState{
+					"aws_thing.test": {
+						Primary: &terraform.InstanceState{
+							Attributes: map[string]string{
+								"rule.#":                    "1",
+								"rule.100.action.#":         "2",
+								"rule.100.action.10.target": "foo",
+								"rule.100.action.10.field":  "x",
+								"rule.100.action.20.target": "bar",
+								"rule.100.action.20.field":  "y",
+								"rule.100.extra.#":          "2",
+								"rule.100.extra.1":          "a",
+								"rule.100.extra.2":          "b",
+								"ports.#":                   "2",
+								"ports.111":                 "80",
+								"ports.222":                 "443",
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestTestCheckTypeSetElemNestedAttrs(t *testing.T) {
+	s := testTypeSetState()
+
+	if err := TestCheckTypeSetElemNestedAttrs("aws_thing.test", "rule.*.action", map[string]string{"target": "bar"})(s); err != nil {
+		t.Errorf("expected wildcard key match to succeed, got: %s", err)
+	}
+
+	if err := TestCheckTypeSetElemNestedAttrs("aws_thing.test", "rule", map[string]string{"action.*.field": "y"})(s); err != nil {
+		t.Errorf("expected wildcard value match to succeed, got: %s", err)
+	}
+
+	if err := TestCheckTypeSetElemNestedAttrs("aws_thing.test", "rule.*.action", map[string]string{"target": "missing"})(s); err == nil {
+		t.Error("expected no-match error, got nil")
+	} else if !strings.Contains(err.Error(), "No TypeSet element with attr/value pairs") {
+		t.Errorf("unexpected error for no match: %s", err)
+	}
+
+	if err := TestCheckTypeSetElemNestedAttrs("aws_thing.test", "not_a_set", map[string]string{"target": "bar"})(s); err == nil {
+		t.Error("expected not-a-TypeSet error, got nil")
+	} else if !strings.Contains(err.Error(), "does not appear to be a TypeSet") {
+		t.Errorf("unexpected error for mistyped key: %s", err)
+	}
+}
+
+func TestTestCheckTypeSetElemAttr(t *testing.T) {
+	s := testTypeSetState()
+
+	if err := TestCheckTypeSetElemAttr("aws_thing.test", "ports", "443")(s); err != nil {
+		t.Errorf("expected match to succeed, got: %s", err)
+	}
+
+	if err := TestCheckTypeSetElemAttr("aws_thing.test", "rule.*.extra", "b")(s); err != nil {
+		t.Errorf("expected wildcard key match to succeed, got: %s", err)
+	}
+
+	if err := TestCheckTypeSetElemAttr("aws_thing.test", "ports", "8080")(s); err == nil {
+		t.Error("expected no-match error, got nil")
+	}
+}
+
+func TestTestMatchTypeSetElemNestedAttrs(t *testing.T) {
+	s := testTypeSetState()
+
+	values := map[string]*regexp.Regexp{"target": regexp.MustCompile("^ba")}
+	if err := TestMatchTypeSetElemNestedAttrs("aws_thing.test", "rule.*.action", values)(s); err != nil {
+		t.Errorf("expected regexp match to succeed, got: %s", err)
+	}
+
+	noMatch := map[string]*regexp.Regexp{"target": regexp.MustCompile("^zz")}
+	if err := TestMatchTypeSetElemNestedAttrs("aws_thing.test", "rule.*.action", noMatch)(s); err == nil {
+		t.Error("expected no-match error, got nil")
+	}
+
+	if err := TestMatchTypeSetElemNestedAttrs("aws_thing.test", "not_a_set", values)(s); err == nil {
+		t.Error("expected not-a-TypeSet error, got nil")
+	} else if !strings.Contains(err.Error(), "does not appear to be a TypeSet") {
+		t.Errorf("unexpected error for mistyped key: %s", err)
+	}
+}
+
+func TestTestMatchTypeSetElemAttr(t *testing.T) {
+	s := testTypeSetState()
+
+	if err := TestMatchTypeSetElemAttr("aws_thing.test", "ports", regexp.MustCompile("^4"))(s); err != nil {
+		t.Errorf("expected regexp match to succeed, got: %s", err)
+	}
+
+	if err := TestMatchTypeSetElemAttr("aws_thing.test", "ports", regexp.MustCompile("^9"))(s); err == nil {
+		t.Error("expected no-match error, got nil")
+	}
+}
+
+func TestTestCheckTypeSetElemNestedAttrsWith(t *testing.T) {
+	s := testTypeSetState()
+
+	check := func(element map[string]string) error {
+		if element["target"] == "bar" {
+			return nil
+		}
+		return errForTarget(element["target"])
+	}
+	if err := TestCheckTypeSetElemNestedAttrsWith("aws_thing.test", "rule.*.action", check)(s); err != nil {
+		t.Errorf("expected at least one element to satisfy check, got: %s", err)
+	}
+
+	failingCheck := func(element map[string]string) error {
+		return errForTarget(element["target"])
+	}
+	if err := TestCheckTypeSetElemNestedAttrsWith("aws_thing.test", "rule.*.action", failingCheck)(s); err == nil {
+		t.Error("expected an aggregated error when no element satisfies check, got nil")
+	} else if !strings.Contains(err.Error(), "foo") || !strings.Contains(err.Error(), "bar") {
+		t.Errorf("expected aggregated error to mention every failing element, got: %s", err)
+	}
+}
+
+func TestTestCheckTypeSetElemAttrWith(t *testing.T) {
+	s := testTypeSetState()
+
+	check := func(value string) error {
+		if value == "443" {
+			return nil
+		}
+		return errForTarget(value)
+	}
+	if err := TestCheckTypeSetElemAttrWith("aws_thing.test", "ports", check)(s); err != nil {
+		t.Errorf("expected at least one element to satisfy check, got: %s", err)
+	}
+
+	failingCheck := func(value string) error {
+		return errForTarget(value)
+	}
+	if err := TestCheckTypeSetElemAttrWith("aws_thing.test", "ports", failingCheck)(s); err == nil {
+		t.Error("expected an aggregated error when no element satisfies check, got nil")
+	}
+}
+
+func TestTestCheckNoTypeSetElemNestedAttrs(t *testing.T) {
+	s := testTypeSetState()
+
+	if err := TestCheckNoTypeSetElemNestedAttrs("aws_thing.test", "rule.*.action", map[string]string{"target": "missing"})(s); err != nil {
+		t.Errorf("expected success when no element matches, got: %s", err)
+	}
+
+	if err := TestCheckNoTypeSetElemNestedAttrs("aws_thing.test", "rule.*.action", map[string]string{"target": "bar"})(s); err == nil {
+		t.Error("expected an error when a matching element is present, got nil")
+	}
+}
+
+func TestTestCheckTypeSetElemNestedAttrsCount(t *testing.T) {
+	s := testTypeSetState()
+
+	if err := TestCheckTypeSetElemNestedAttrsCount("aws_thing.test", "rule.*.action", map[string]string{"target": "bar"}, 1)(s); err != nil {
+		t.Errorf("expected count of 1 to match, got: %s", err)
+	}
+
+	if err := TestCheckTypeSetElemNestedAttrsCount("aws_thing.test", "rule.*.action", map[string]string{"target": "bar"}, 2)(s); err == nil {
+		t.Error("expected a count mismatch error, got nil")
+	}
+}
+
+func errForTarget(target string) error {
+	return &targetError{target: target}
+}
+
+type targetError struct {
+	target string
+}
+
+func (e *targetError) Error() string {
+	return "target did not satisfy check: " + e.target
+}